@@ -0,0 +1,44 @@
+package rdsbackup
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// backoffDelay returns the delay before retry attempt n (0-indexed):
+// 2s, 4s, 8s, ... capped at 60s, with up to 20% jitter so concurrent
+// callers don't all wake up in lockstep. n is clamped before computing
+// the shift so callers that poll indefinitely (waitForCopy has no bound
+// on how many times it can call this) can't overflow the exponent into a
+// negative duration.
+func backoffDelay(n int) time.Duration {
+	const cap = 60 * time.Second
+	const maxShift = 5 // 1<<(5+1) == 64s, already past cap
+	if n > maxShift {
+		n = maxShift
+	}
+	base := time.Duration(1<<uint(n+1)) * time.Second
+	if base > cap {
+		base = cap
+	}
+	jitter := time.Duration(rand.Int63n(int64(base) / 5))
+	return base + jitter
+}
+
+// isTransientAWSErr reports whether err looks like a throttling or
+// rate-limit error worth retrying, as opposed to a terminal failure
+// (bad request, missing resource, permission denied) that should abort
+// immediately.
+func isTransientAWSErr(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequestsException":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package rdsbackup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelayCapped(t *testing.T) {
+	const cap = 60 * time.Second
+	cases := []int{0, 1, 5, 6, 33, 1000, 1 << 20}
+	for _, n := range cases {
+		d := backoffDelay(n)
+		if d <= 0 {
+			t.Errorf("backoffDelay(%d) = %v, want a positive delay", n, d)
+		}
+		if d > cap+cap/5 {
+			t.Errorf("backoffDelay(%d) = %v, want at most cap+jitter (%v)", n, d, cap+cap/5)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package rdsbackup
+
+import "time"
+
+// Event is a single progress update emitted while waiting for a snapshot
+// copy to complete. The CLI renders these as progress lines; library
+// consumers can read them directly off Options.Events.
+type Event struct {
+	Phase      string
+	SnapshotID string
+	Percent    int64
+	Status     string
+	At         time.Time
+}
+
+// emit sends e on ch without blocking forever if nobody is reading: a full
+// unbuffered channel just means this particular update is dropped, not that
+// the backup should stall waiting for a slow consumer.
+func emit(ch chan<- Event, e Event) {
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- e:
+	default:
+	}
+}
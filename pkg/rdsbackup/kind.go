@@ -0,0 +1,35 @@
+package rdsbackup
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// Kind distinguishes a plain RDS instance from an Aurora cluster, since the
+// two use entirely different snapshot APIs and ARN formats.
+type Kind string
+
+const (
+	KindInstance Kind = "instance"
+	KindCluster  Kind = "cluster"
+	KindAuto     Kind = "auto"
+)
+
+// resolveKind returns kind as-is unless it's KindAuto/empty, in which case
+// it asks RDS whether id is a DB cluster or a DB instance.
+func resolveKind(sess *session.Session, region, id string, kind Kind) (Kind, error) {
+	if kind != "" && kind != KindAuto {
+		return kind, nil
+	}
+	cli := rds.New(sess, aws.NewConfig().WithRegion(region))
+	if _, err := cli.DescribeDBClusters(&rds.DescribeDBClustersInput{DBClusterIdentifier: aws.String(id)}); err == nil {
+		return KindCluster, nil
+	}
+	if _, err := cli.DescribeDBInstances(&rds.DescribeDBInstancesInput{DBInstanceIdentifier: aws.String(id)}); err == nil {
+		return KindInstance, nil
+	}
+	return "", fmt.Errorf("%q is neither a DB cluster nor a DB instance", id)
+}
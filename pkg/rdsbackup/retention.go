@@ -0,0 +1,147 @@
+package rdsbackup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy describes a restic-style keep policy for pruning
+// snapshots: keep the N most recent, plus the newest snapshot in each of
+// the N most recent periodic buckets (hourly/daily/weekly/monthly/yearly)
+// that contain a snapshot, plus anything created within a trailing
+// duration.
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	KeepWithin  time.Duration
+}
+
+// Empty returns true if no retention rule was configured.
+func (p RetentionPolicy) Empty() bool {
+	return p.KeepLast == 0 && p.KeepHourly == 0 && p.KeepDaily == 0 &&
+		p.KeepWeekly == 0 && p.KeepMonthly == 0 && p.KeepYearly == 0 && p.KeepWithin == 0
+}
+
+// bucketKey returns a string that uniquely identifies the period a snapshot
+// falls into for a given bucket size, e.g. all snapshots from the same
+// calendar day produce the same "daily" key.
+func bucketKey(t time.Time, bucket string) string {
+	switch bucket {
+	case "hourly":
+		return t.Format("2006-01-02T15")
+	case "daily":
+		return t.Format("2006-01-02")
+	case "weekly":
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	case "monthly":
+		return t.Format("2006-01")
+	case "yearly":
+		return t.Format("2006")
+	}
+	return ""
+}
+
+// keepBucketed walks snaps in the order given and keeps the first snapshot
+// seen in each of up to n distinct buckets. snaps must already be sorted
+// newest->oldest for that to be the newest snapshot of each bucket;
+// keepBucketed does not sort them.
+func keepBucketed(snaps []Snapshot, bucket string, n int) map[string]bool {
+	keep := map[string]bool{}
+	if n <= 0 {
+		return keep
+	}
+	seen := map[string]bool{}
+	for _, s := range snaps {
+		k := bucketKey(s.CreateTime, bucket)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		keep[s.ID] = true
+		if len(seen) >= n {
+			break
+		}
+	}
+	return keep
+}
+
+// applyRetention computes the set of snapshot IDs to delete for the given
+// policy. If the policy is empty or would keep nothing, applyRetention
+// keeps everything (safety invariant: never produce an empty keep-set).
+func applyRetention(snaps []Snapshot, p RetentionPolicy) []string {
+	if p.Empty() || len(snaps) == 0 {
+		return nil
+	}
+	sorted := make([]Snapshot, len(snaps))
+	copy(sorted, snaps)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreateTime.After(sorted[j].CreateTime) })
+
+	keep := map[string]bool{}
+	for i, s := range sorted {
+		if i < p.KeepLast {
+			keep[s.ID] = true
+		}
+	}
+	if p.KeepWithin > 0 {
+		cutoff := time.Now().Add(-p.KeepWithin)
+		for _, s := range sorted {
+			if s.CreateTime.After(cutoff) {
+				keep[s.ID] = true
+			}
+		}
+	}
+	for id := range keepBucketed(sorted, "hourly", p.KeepHourly) {
+		keep[id] = true
+	}
+	for id := range keepBucketed(sorted, "daily", p.KeepDaily) {
+		keep[id] = true
+	}
+	for id := range keepBucketed(sorted, "weekly", p.KeepWeekly) {
+		keep[id] = true
+	}
+	for id := range keepBucketed(sorted, "monthly", p.KeepMonthly) {
+		keep[id] = true
+	}
+	for id := range keepBucketed(sorted, "yearly", p.KeepYearly) {
+		keep[id] = true
+	}
+
+	if len(keep) == 0 {
+		// Safety invariant: a policy that keeps nothing keeps everything instead.
+		return nil
+	}
+
+	var remove []string
+	for _, s := range sorted {
+		if !keep[s.ID] {
+			remove = append(remove, s.ID)
+		}
+	}
+	return remove
+}
+
+// ParseKeepWithin parses a restic-style duration like "7d" or "48h". Go's
+// time.ParseDuration doesn't understand "d" for days, so we handle it here.
+func ParseKeepWithin(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if s[len(s)-1] == 'd' {
+		days, err := time.ParseDuration(s[:len(s)-1] + "h")
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %v", s, err)
+		}
+		return days * 24, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	return d, nil
+}
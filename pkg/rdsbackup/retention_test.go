@@ -0,0 +1,120 @@
+package rdsbackup
+
+import (
+	"testing"
+	"time"
+)
+
+func snap(id string, t time.Time) Snapshot {
+	return Snapshot{ID: id, CreateTime: t}
+}
+
+func TestBucketKey(t *testing.T) {
+	ref := time.Date(2026, 3, 5, 14, 30, 0, 0, time.UTC)
+	cases := []struct {
+		bucket string
+		want   string
+	}{
+		{"hourly", "2026-03-05T14"},
+		{"daily", "2026-03-05"},
+		{"weekly", "2026-W10"},
+		{"monthly", "2026-03"},
+		{"yearly", "2026"},
+		{"unknown", ""},
+	}
+	for _, c := range cases {
+		if got := bucketKey(ref, c.bucket); got != c.want {
+			t.Errorf("bucketKey(%s) = %q, want %q", c.bucket, got, c.want)
+		}
+	}
+}
+
+func TestKeepBucketed(t *testing.T) {
+	now := time.Date(2026, 3, 5, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{
+		snap("d0", now),
+		snap("d1", now.AddDate(0, 0, -1)),
+		snap("d2", now.AddDate(0, 0, -1).Add(-time.Hour)), // same day as d1, older
+		snap("d3", now.AddDate(0, 0, -2)),
+	}
+
+	keep := keepBucketed(snaps, "daily", 2)
+	if len(keep) != 2 || !keep["d0"] || !keep["d1"] {
+		t.Errorf("keepBucketed daily n=2 = %v, want {d0, d1}", keep)
+	}
+
+	if keep := keepBucketed(snaps, "daily", 0); len(keep) != 0 {
+		t.Errorf("keepBucketed with n=0 should keep nothing, got %v", keep)
+	}
+}
+
+func TestApplyRetentionKeepLastAndWithinUnion(t *testing.T) {
+	// applyRetention measures KeepWithin from the wall clock, so the
+	// fixture has to be relative to it too.
+	now := time.Now()
+	snaps := []Snapshot{
+		snap("newest", now),
+		snap("within", now.AddDate(0, 0, -3)),
+		snap("old1", now.AddDate(0, 0, -10)),
+		snap("old2", now.AddDate(0, 0, -20)),
+	}
+	p := RetentionPolicy{KeepLast: 1, KeepWithin: 5 * 24 * time.Hour}
+
+	remove := applyRetention(snaps, p)
+	removed := map[string]bool{}
+	for _, id := range remove {
+		removed[id] = true
+	}
+	if len(removed) != 2 || !removed["old1"] || !removed["old2"] {
+		t.Errorf("applyRetention removed %v, want {old1, old2}", removed)
+	}
+	if removed["newest"] || removed["within"] {
+		t.Errorf("applyRetention removed a snapshot kept by KeepLast/KeepWithin: %v", removed)
+	}
+}
+
+func TestApplyRetentionEmptyPolicyKeepsEverything(t *testing.T) {
+	snaps := []Snapshot{snap("a", time.Now().Add(-time.Hour))}
+	if remove := applyRetention(snaps, RetentionPolicy{}); remove != nil {
+		t.Errorf("applyRetention with empty policy = %v, want nil", remove)
+	}
+}
+
+func TestApplyRetentionEmptyKeepSetKeepsEverything(t *testing.T) {
+	now := time.Date(2026, 3, 5, 12, 0, 0, 0, time.UTC)
+	snaps := []Snapshot{
+		snap("a", now.AddDate(0, 0, -100)),
+		snap("b", now.AddDate(0, 0, -200)),
+	}
+	// KeepWithin excludes both, and nothing else is configured, so the
+	// safety invariant must kick in and keep everything rather than
+	// deleting every snapshot we have.
+	p := RetentionPolicy{KeepWithin: time.Hour}
+	if remove := applyRetention(snaps, p); remove != nil {
+		t.Errorf("applyRetention with an empty keep-set = %v, want nil (keep everything)", remove)
+	}
+}
+
+func TestParseKeepWithin(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"48h", 48 * time.Hour, false},
+		{"30m", 30 * time.Minute, false},
+		{"nope", 0, true},
+	}
+	for _, c := range cases {
+		got, err := ParseKeepWithin(c.in)
+		if (err != nil) != c.wantErr {
+			t.Errorf("ParseKeepWithin(%q) error = %v, wantErr %v", c.in, err, c.wantErr)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("ParseKeepWithin(%q) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
@@ -1,14 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"github.com/AppliedTrust/rdsbackup/pkg/rdsbackup"
 	"github.com/docopt/docopt-go"
-	"github.com/stripe/aws-go/aws"
-	"github.com/stripe/aws-go/gen/iam"
-	"github.com/stripe/aws-go/gen/rds"
 	"log"
 	"os"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -24,285 +22,201 @@ Usage:
   rdsbackup --version
 
 AWS Authentication:
-  Either use the -K and -S flags, or
-  set the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+  Credentials are resolved in this order: the -K/-S flags, the
+  AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY environment variables, a shared
+  config/credentials profile (--profile), then the SDK's default chain
+  (further environment variables, EC2/ECS/Lambda instance role). Pass
+  --role-arn to assume a role on top of whichever of those resolves.
 
 Options:
-  -s, --source=<region>     AWS region of source RDS instance [default: us-east-1].
-  -d, --dest=<region>       AWS region to store backup RDS snapshot [default: us-west-1].
+  -s, --source=<region>     AWS region of source RDS instance (discovered from
+                             the environment/profile if omitted).
+  -d, --dest=<regions>      Comma-separated AWS region(s) to store backup RDS snapshot(s)
+                            in (discovered from the environment/profile if omitted).
+                            Multiple regions are copied to concurrently.
+  --max-parallel=<n>        Copy to at most <n> destination regions at once [default: 0].
+                            0 means no limit (copy to every region at once).
   -K, --awskey=<keyid>      AWS key ID (or use AWS_ACCESS_KEY_ID environemnt variable).
   -S, --awssecret=<secret>  AWS secret key (or use AWS_SECRET_ACCESS_KEY environemnt variable).
+  --profile=<name>          Use this named profile from the AWS shared config/credentials files.
+  --role-arn=<arn>          Assume this role before talking to AWS.
+  --kind=<kind>             Is <db_instance_id> an "instance" or Aurora "cluster"? [default: auto]
+                            auto detects it by asking RDS.
+  --kms-key-id=<id>         Encrypt the copied snapshot with this KMS key (required to copy an
+                             already-encrypted snapshot cross-region).
+  --copy-tags               Copy all source snapshot tags to the destination snapshot.
+  --option-group=<name>     Option group to associate with the copied snapshot.
+  --wait=<bool>             Wait for the copy to finish before purging old snapshots [default: true].
+                            Pass --wait=false to start the copy and exit immediately.
+  --timeout=<duration>      Give up waiting for the copy after <duration> (e.g. 30m, 2h).
   -p, --purge=<count>       Purge oldest snapshots from dest region if more than <count> exist.
+  --keep-last=<n>           Keep the <n> most recent snapshots, regardless of age.
+  --keep-hourly=<n>         Keep the most recent snapshot for each of the last <n> hours that have one.
+  --keep-daily=<n>          Keep the most recent snapshot for each of the last <n> days that have one.
+  --keep-weekly=<n>         Keep the most recent snapshot for each of the last <n> weeks that have one.
+  --keep-monthly=<n>        Keep the most recent snapshot for each of the last <n> months that have one.
+  --keep-yearly=<n>         Keep the most recent snapshot for each of the last <n> years that have one.
+  --keep-within=<duration>  Keep all snapshots made within <duration> of now (e.g. 7d).
   -q, --quiet               Silence all output except errors.
   -h, --help                Show this screen.
   --version                 Show version.
 `
 
-type config struct {
-	dbid      string
-	src       string
-	dst       string
-	arn       string
-	copyId    string
-	awsAcctId string
-	awsKeyId  string
-	awsSecret string
-	purge     int
-	quiet     bool
-	creds     aws.CredentialsProvider
-}
-
+// main is a thin CLI wrapper around the rdsbackup library: it parses flags
+// into rdsbackup.Options and hands off to rdsbackup.Run.
 func main() {
-	c, err := parseArgs()
-	if err != nil {
-		log.Fatal(err)
-	}
-	c.awsAcctId, err = c.findAcccountID()
+	opts, err := parseArgs()
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err = c.findLatestSnap(); err != nil {
-		log.Fatal(err)
-	}
-	if c.checkSnapCopied() {
-		c.debug("Source snapshot has already been copied to destination region.")
-		os.Exit(0)
-	}
-	if err = c.copySnap(); err != nil {
-		log.Fatal(err)
-	}
-	if err = c.waitForCopy(); err != nil {
-		log.Fatal(err)
+	if !opts.Quiet {
+		opts.Debug = func(s string) { log.Println(s) }
+	}
+	events := make(chan rdsbackup.Event, 16)
+	opts.Events = events
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			if !opts.Quiet {
+				log.Printf("[%s] %s: %s (%d%%)", e.Phase, e.SnapshotID, e.Status, e.Percent)
+			}
+		}
+	}()
+	res, err := rdsbackup.Run(context.Background(), opts)
+	close(events)
+	<-done
+	for _, rr := range res.Regions {
+		if rr.Err != nil {
+			log.Printf("[%s] FAILED: %v", rr.Region, rr.Err)
+		}
 	}
-	if err = c.cleanupSnaps(); err != nil {
+	if err != nil {
 		log.Fatal(err)
 	}
-	c.debug("All done!")
 	os.Exit(0)
 }
 
 // parseArgs handles command line flags
-func parseArgs() (config, error) {
-	c := config{}
+func parseArgs() (rdsbackup.Options, error) {
+	opts := rdsbackup.Options{}
 	args, err := docopt.Parse(usage, nil, true, version, false)
 	if err != nil {
-		return c, err
+		return opts, err
 	}
 	if purge, ok := args["--purge"].(string); ok {
-		c.purge, err = strconv.Atoi(purge)
-		if err != nil {
-			return c, err
+		if opts.Purge, err = strconv.Atoi(purge); err != nil {
+			return opts, err
 		}
-	} else {
-		c.purge = 0
 	}
-	c.dbid = args["<db_instance_id>"].(string)
-	c.src = args["--source"].(string)
-	c.dst = args["--dest"].(string)
-	c.quiet = args["--quiet"].(bool)
-	if arg, ok := args["--awskey"].(string); ok {
-		c.awsKeyId = arg
-	} else {
-		c.awsKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	if opts.Retention, err = parseRetentionFlags(args); err != nil {
+		return opts, err
 	}
-	if arg, ok := args["--awssecret"].(string); ok {
-		c.awsSecret = arg
-	} else {
-		c.awsSecret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	opts.DBInstanceID = args["<db_instance_id>"].(string)
+	if arg, ok := args["--source"].(string); ok {
+		opts.SourceRegion = arg
 	}
-	if len(c.awsKeyId) < 1 || len(c.awsSecret) < 1 {
-		return c, fmt.Errorf("Must use -K and -S options or set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.")
+	if arg, ok := args["--dest"].(string); ok {
+		for _, r := range strings.Split(arg, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				opts.DestRegions = append(opts.DestRegions, r)
+			}
+		}
 	}
-	c.creds = aws.Creds(c.awsKeyId, c.awsSecret, "")
-	return c, nil
-}
-
-// findAcccountID returns the AWS account ID
-func (c *config) findAcccountID() (string, error) {
-	i := iam.New(c.creds, c.src, nil)
-	u, err := i.GetUser(nil)
-	if err != nil {
-		return "", err
+	if len(opts.DestRegions) == 0 {
+		opts.DestRegions = []string{""}
 	}
-	parts := strings.Split(*u.User.ARN, ":")
-	if len(parts) != 6 {
-		return "", fmt.Errorf("Error parsing user ARN")
+	if arg, ok := args["--max-parallel"].(string); ok {
+		if opts.MaxParallel, err = strconv.Atoi(arg); err != nil {
+			return opts, fmt.Errorf("invalid --max-parallel value %q: %v", arg, err)
+		}
 	}
-	return parts[4], nil
-}
-
-// findLatestSnap finds the source snapshot to copy
-func (c *config) findLatestSnap() error {
-	cli := rds.New(c.creds, c.src, nil)
-	c.debug(fmt.Sprintf("Searching for snapshots for: %s", c.dbid))
-	q := rds.DescribeDBSnapshotsMessage{}
-	q.DBInstanceIdentifier = aws.String(c.dbid)
-	resp, err := cli.DescribeDBSnapshots(&q)
-	if err != nil {
-		return err
+	opts.Quiet = args["--quiet"].(bool)
+	if arg, ok := args["--profile"].(string); ok {
+		opts.Profile = arg
 	}
-	newest := time.Unix(0, 0)
-	newestId := ""
-	if len(resp.DBSnapshots) < 1 {
-		return fmt.Errorf("No snapshots found")
+	if arg, ok := args["--role-arn"].(string); ok {
+		opts.RoleARN = arg
 	}
-	c.debug(fmt.Sprintf("Found %d snapshots for: %s", len(resp.DBSnapshots), c.dbid))
-	for _, r := range resp.DBSnapshots {
-		if r.SnapshotCreateTime.After(newest) {
-			newestId = *r.DBSnapshotIdentifier
-			newest = r.SnapshotCreateTime
+	if arg, ok := args["--kind"].(string); ok {
+		switch arg {
+		case "instance", "cluster", "auto":
+			opts.Kind = rdsbackup.Kind(arg)
+		default:
+			return opts, fmt.Errorf("invalid --kind value %q: must be instance, cluster, or auto", arg)
 		}
 	}
-	if len(newestId) < 1 {
-		return fmt.Errorf("No usable snapshot found")
+	if arg, ok := args["--kms-key-id"].(string); ok {
+		opts.KMSKeyID = arg
 	}
-	c.arn = fmt.Sprintf("arn:aws:rds:%s:%s:snapshot:%s", c.src, c.awsAcctId, newestId)
-	c.debug(fmt.Sprintf("Found latest snapshot: %s: %s", newestId, newest.String()))
-	return nil
-}
-
-// checkSnapCopied returns true if the source snapshot has already been copied to the destination region
-func (c *config) checkSnapCopied() bool {
-	cli := rds.New(c.creds, c.dst, nil)
-	q := rds.DescribeDBSnapshotsMessage{}
-	q.DBInstanceIdentifier = aws.String(c.dbid)
-	resp, err := cli.DescribeDBSnapshots(&q)
-	if err != nil {
-		return false
+	if arg, ok := args["--option-group"].(string); ok {
+		opts.OptionGroupName = arg
 	}
-	for _, s := range resp.DBSnapshots {
-		q := rds.ListTagsForResourceMessage{ResourceName: aws.String(fmt.Sprintf("arn:aws:rds:%s:%s:snapshot:%s", c.dst, c.awsAcctId, *s.DBSnapshotIdentifier))}
-		tags, err := cli.ListTagsForResource(&q)
+	opts.CopyTags = args["--copy-tags"].(bool)
+	if wait, ok := args["--wait"].(string); ok {
+		w, err := strconv.ParseBool(wait)
 		if err != nil {
-			continue
-		}
-		managedByUs := false
-		matchedSource := false
-		for _, t := range tags.TagList {
-			if *t.Key == "managedby" && *t.Value == "rdsbackup" {
-				managedByUs = true
-			} else if *t.Key == "sourcearn" && *t.Value == c.arn {
-				matchedSource = true
-			}
+			return opts, fmt.Errorf("invalid --wait value %q: %v", wait, err)
 		}
-		if managedByUs && matchedSource {
-			return true
+		opts.NoWait = !w
+	}
+	if timeout, ok := args["--timeout"].(string); ok {
+		if opts.Timeout, err = time.ParseDuration(timeout); err != nil {
+			return opts, fmt.Errorf("invalid --timeout value %q: %v", timeout, err)
 		}
 	}
-	return false
-}
-
-// copySnap starts the RDS snapshot copy
-func (c *config) copySnap() error {
-	cli := rds.New(c.creds, c.dst, nil)
-	t := time.Now()
-	c.copyId = fmt.Sprintf("%s-%s", c.dbid, t.Format("2006-01-02at15-04MST"))
-	m := rds.CopyDBSnapshotMessage{
-		SourceDBSnapshotIdentifier: aws.String(c.arn),
-		Tags: []rds.Tag{
-			rds.Tag{aws.String("time"), aws.String(t.Format("2006-01-02 15:04:05 -0700"))},
-			rds.Tag{aws.String("timestamp"), aws.String(fmt.Sprintf("%d", t.Unix()))},
-			rds.Tag{aws.String("source"), aws.String(c.src)},
-			rds.Tag{aws.String("sourceid"), aws.String(c.dbid)},
-			rds.Tag{aws.String("sourcearn"), aws.String(c.arn)},
-			rds.Tag{aws.String("managedby"), aws.String("rdsbackup")},
-		},
-		TargetDBSnapshotIdentifier: aws.String(c.copyId),
+	if arg, ok := args["--awskey"].(string); ok {
+		opts.AWSKeyID = arg
+	} else {
+		opts.AWSKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
 	}
-	resp, err := cli.CopyDBSnapshot(&m)
-	if err != nil {
-		return err
-	} else if *resp.DBSnapshot.Status != "creating" {
-		return fmt.Errorf("Error creating snapshot - unexpected status: %s", *resp.DBSnapshot.Status)
+	if arg, ok := args["--awssecret"].(string); ok {
+		opts.AWSSecret = arg
+	} else {
+		opts.AWSSecret = os.Getenv("AWS_SECRET_ACCESS_KEY")
 	}
-	return nil
+	return opts, nil
 }
 
-// waitForCopy waits for the RDS snapshot copy to finish
-func (c *config) waitForCopy() error {
-	c.debug(fmt.Sprintf("Waiting for copy %s...", c.copyId))
-	cli := rds.New(c.creds, c.dst, nil)
-	q := rds.DescribeDBSnapshotsMessage{}
-	q.DBSnapshotIdentifier = aws.String(c.copyId)
-	for {
-		resp, err := cli.DescribeDBSnapshots(&q)
-		if err != nil {
-			return err
-		}
-		if len(resp.DBSnapshots) != 1 {
-			return fmt.Errorf("New snapshot missing!")
-		}
-		s := resp.DBSnapshots[0]
-		if *s.Status != "creating" {
-			break
-		}
-		c.debug(fmt.Sprintf("Waiting %s (%d%% complete)", *s.Status, *s.PercentProgress))
-		time.Sleep(10 * time.Second)
+// parseRetentionFlags builds a rdsbackup.RetentionPolicy from parsed docopt args.
+func parseRetentionFlags(args map[string]interface{}) (rdsbackup.RetentionPolicy, error) {
+	p := rdsbackup.RetentionPolicy{}
+	var err error
+	if p.KeepLast, err = keepFlagInt(args, "--keep-last"); err != nil {
+		return p, err
 	}
-	return nil
-}
-
-// cleanupSnaps
-func (c *config) cleanupSnaps() error {
-	if c.purge <= 0 {
-		return nil
+	if p.KeepHourly, err = keepFlagInt(args, "--keep-hourly"); err != nil {
+		return p, err
 	}
-	c.debug(fmt.Sprintf("Cleaning up old snapshots in dest region %s...", c.dst))
-	cli := rds.New(c.creds, c.dst, nil)
-	q := rds.DescribeDBSnapshotsMessage{}
-	q.DBInstanceIdentifier = aws.String(c.dbid)
-	resp, err := cli.DescribeDBSnapshots(&q)
-	if err != nil {
-		return err
+	if p.KeepDaily, err = keepFlagInt(args, "--keep-daily"); err != nil {
+		return p, err
 	}
-	snaps := map[int64]string{}
-	keys := int64arr{}
-	for _, s := range resp.DBSnapshots {
-		q := rds.ListTagsForResourceMessage{ResourceName: aws.String(fmt.Sprintf("arn:aws:rds:%s:%s:snapshot:%s", c.dst, c.awsAcctId, *s.DBSnapshotIdentifier))}
-		tags, err := cli.ListTagsForResource(&q)
-		if err != nil {
-			continue
-		}
-		for _, t := range tags.TagList {
-			if *t.Key == "managedby" && *t.Value == "rdsbackup" {
-				if s.SnapshotCreateTime.Unix() > 0 {
-					snaps[s.SnapshotCreateTime.Unix()] = *s.DBSnapshotIdentifier
-					keys = append(keys, s.SnapshotCreateTime.Unix())
-				}
-			}
-		}
+	if p.KeepWeekly, err = keepFlagInt(args, "--keep-weekly"); err != nil {
+		return p, err
 	}
-	if len(snaps) <= c.purge {
-		c.debug(fmt.Sprintf("Found %d snapshots. Purge flag is %d, so nothing will be purged.", len(snaps), c.purge))
-	} else {
-		c.debug(fmt.Sprintf("Found %d snapshots. Purge flag is %d, so the oldest %d snapshots will be purged.", len(snaps), c.purge, len(snaps)-c.purge))
-		sort.Sort(keys)
-		for i := 0; i < len(snaps)-c.purge; i++ {
-			c.debug(fmt.Sprintf("Purging snapshot %s.", snaps[keys[i]]))
-			q := rds.DeleteDBSnapshotMessage{DBSnapshotIdentifier: aws.String(snaps[keys[i]])}
-			resp, err := cli.DeleteDBSnapshot(&q)
-			if err != nil {
-				return err
-			}
-			if *resp.DBSnapshot.Status != "deleted" {
-				c.debug(fmt.Sprintf("Warning: snapshot was not deleted successfully: %s", snaps[keys[i]]))
-			}
+	if p.KeepMonthly, err = keepFlagInt(args, "--keep-monthly"); err != nil {
+		return p, err
+	}
+	if p.KeepYearly, err = keepFlagInt(args, "--keep-yearly"); err != nil {
+		return p, err
+	}
+	if within, ok := args["--keep-within"].(string); ok {
+		if p.KeepWithin, err = rdsbackup.ParseKeepWithin(within); err != nil {
+			return p, err
 		}
-		c.debug("Done purging shapshots.")
 	}
-	return nil
+	return p, nil
 }
 
-// debug prints debugging mesages if enabled
-func (c *config) debug(s string) {
-	if !c.quiet {
-		log.Println(s)
+// keepFlagInt reads an integer-valued docopt flag, returning 0 if unset.
+func keepFlagInt(args map[string]interface{}, flag string) (int, error) {
+	v, ok := args[flag].(string)
+	if !ok {
+		return 0, nil
 	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s value %q: %v", flag, v, err)
+	}
+	return n, nil
 }
-
-// int64arr supports sorting by unix timestamp
-type int64arr []int64
-
-func (a int64arr) Len() int           { return len(a) }
-func (a int64arr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a int64arr) Less(i, j int) bool { return a[i] < a[j] }